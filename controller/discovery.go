@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// haDiscoveryConfig mirrors the subset of Home Assistant's MQTT "cover"
+// discovery schema needed to auto-register a garage door.
+type haDiscoveryConfig struct {
+	Name                string `json:"name"`
+	UniqueID            string `json:"unique_id"`
+	DeviceClass         string `json:"device_class"`
+	StateTopic          string `json:"state_topic"`
+	CommandTopic        string `json:"command_topic"`
+	PayloadOpen         string `json:"payload_open"`
+	PayloadClose        string `json:"payload_close"`
+	StateOpen           string `json:"state_open"`
+	StateClosed         string `json:"state_closed"`
+	StateOpening        string `json:"state_opening"`
+	StateClosing        string `json:"state_closing"`
+	AvailabilityTopic   string `json:"availability_topic"`
+	PayloadAvailable    string `json:"payload_available"`
+	PayloadNotAvailable string `json:"payload_not_available"`
+}
+
+// publishDiscovery publishes a retained Home Assistant MQTT Discovery
+// config for this door as a "cover" device, so Home Assistant auto-
+// registers it on connect. It is a no-op unless HADiscovery is enabled.
+func (controller *GarageController) publishDiscovery(presenceTopic string) {
+	if !controller.config.HADiscovery {
+		return
+	}
+
+	id := controller.config.HADeviceID
+	if id == "" {
+		id = haSlug(controller.config.Name)
+	}
+
+	payload := haDiscoveryConfig{
+		Name:                controller.config.Name,
+		UniqueID:            id,
+		DeviceClass:         "garage",
+		StateTopic:          controller.config.MQTTTopicStatus,
+		CommandTopic:        controller.config.MQTTTopicControl,
+		PayloadOpen:         "O",
+		PayloadClose:        "C",
+		StateOpen:           "O",
+		StateClosed:         "C",
+		StateOpening:        "U",
+		StateClosing:        "D",
+		AvailabilityTopic:   presenceTopic,
+		PayloadAvailable:    presenceOnline,
+		PayloadNotAvailable: presenceOffline,
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		controller.log.Errorf("Unable to marshal discovery config for '%s': %v", controller.config.Name, err)
+		return
+	}
+
+	topic := fmt.Sprintf("homeassistant/cover/%s/config", id)
+	controller.publish(topic, true, body)
+}
+
+// haSlug turns a door name into a reasonable default unique id: trimmed,
+// lowercase, with each space replaced by an underscore.
+func haSlug(name string) string {
+	return strings.ReplaceAll(strings.ToLower(strings.TrimSpace(name)), " ", "_")
+}
+
+// jsonStatus is the payload published on MQTTTopicStatusJSON when
+// StatusFormat is "json".
+type jsonStatus struct {
+	State  string    `json:"state"`
+	Moving bool      `json:"moving"`
+	Since  time.Time `json:"since"`
+}
+
+// publishJSONStatus publishes the current door state as JSON in parallel
+// with the legacy single-character payload. It is a no-op unless
+// StatusFormat is "json".
+func (controller *GarageController) publishJSONStatus() {
+	if controller.config.StatusFormat != "json" {
+		return
+	}
+
+	topic := controller.config.MQTTTopicStatusJSON
+	if topic == "" {
+		topic = controller.config.MQTTTopicStatus + "/json"
+	}
+
+	controller.mu.Lock()
+	state := controller.currentDoorState
+	moving := controller.movingStatus
+	since := controller.stateSince
+	controller.mu.Unlock()
+
+	payload := jsonStatus{
+		State:  strings.ToLower(state.String()),
+		Moving: moving,
+		Since:  since,
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		controller.log.Errorf("Unable to marshal JSON status for '%s': %v", controller.config.Name, err)
+		return
+	}
+
+	controller.publish(topic, true, body)
+}
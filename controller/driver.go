@@ -0,0 +1,293 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang"
+	"github.com/op/go-logging"
+	"github.com/stianeikeland/go-rpio"
+)
+
+// DoorDriver abstracts the physical or remote mechanism used to read and
+// actuate a single garage door. GarageController talks only to this
+// interface, so it does not need to know whether the door is wired to a
+// relay and reed switch on this Pi's GPIO header or is a device that
+// already speaks MQTT natively.
+type DoorDriver interface {
+	// ReadState returns the driver's current view of the door's open/closed
+	// state. Drivers that cannot distinguish transitional states may return
+	// DoorOpen or DoorClosed only.
+	ReadState() DoorState
+	// Trigger issues a command to the door. cmd is "O" to open or "C" to
+	// close.
+	Trigger(cmd string) error
+	// Subscribe registers a channel that receives state updates pushed by
+	// the driver itself, for drivers backed by an external source of truth
+	// (e.g. a device publishing its own MQTT status). Drivers with no push
+	// source may treat this as a no-op.
+	Subscribe(ch chan DoorState)
+	// Start begins any background work the driver needs (e.g. connecting
+	// to a remote broker), and is called only after every Subscribe call
+	// has registered, so a state pushed immediately on connect is never
+	// dropped. Drivers with nothing to start may treat this as a no-op.
+	Start()
+	// Polls reports whether ReadState reflects the door's live state and
+	// can be trusted by the poll loop. Push-only drivers (e.g. ratgdo)
+	// return false, so the controller relies on pushed state instead of
+	// overwriting it with ReadState's default value on every poll.
+	Polls() bool
+}
+
+// GPIODriver drives a door wired directly to this Pi's GPIO header: a reed
+// switch for status and a relay for triggering the opener.
+type GPIODriver struct {
+	pinStatus  rpio.Pin
+	pinControl rpio.Pin
+}
+
+// NewGPIODriver creates a GPIODriver from the given status and control pin
+// numbers, configuring their GPIO modes.
+func NewGPIODriver(pinStatus int, pinControl int) *GPIODriver {
+	status := rpio.Pin(pinStatus)
+	status.Mode(rpio.Input)
+	status.Pull(rpio.PullDown)
+
+	control := rpio.Pin(pinControl)
+	control.Mode(rpio.Output)
+
+	return &GPIODriver{
+		pinStatus:  status,
+		pinControl: control,
+	}
+}
+
+// ReadState reads the reed switch and reports the door as open or closed.
+func (driver *GPIODriver) ReadState() DoorState {
+	if rpio.ReadPin(driver.pinStatus) == rpio.High {
+		return DoorOpen
+	}
+	return DoorClosed
+}
+
+// Trigger pulses the relay. The relay toggles the opener regardless of
+// direction, so cmd is accepted but not inspected.
+func (driver *GPIODriver) Trigger(cmd string) error {
+	rpio.WritePin(driver.pinControl, rpio.High)
+	time.Sleep(250 * time.Millisecond)
+	rpio.WritePin(driver.pinControl, rpio.Low)
+	return nil
+}
+
+// Subscribe is a no-op: the GPIO driver has no push source, it is only
+// ever polled via ReadState.
+func (driver *GPIODriver) Subscribe(ch chan DoorState) {
+}
+
+// Start is a no-op: the GPIO driver has nothing to connect.
+func (driver *GPIODriver) Start() {
+}
+
+// Polls is true: ReadState reads the reed switch live on every call.
+func (driver *GPIODriver) Polls() bool {
+	return true
+}
+
+// RatgdoDriver drives a door opener that already exposes a ratgdo-style
+// MQTT interface, mirroring the topic layout used by ratgdo and similar
+// MQTT-native door-opener controllers: status is read from
+// ratgdo/<id>/status/door and commands are published to
+// ratgdo/<id>/command/door on a broker that may be distinct from the one
+// GarageController itself uses for its own status/control topics.
+type RatgdoDriver struct {
+	client       mqtt.Client
+	log          *logging.Logger
+	topicStatus  string
+	topicCommand string
+	qos          byte
+	config       DoorConfig
+
+	mu          sync.Mutex
+	subscribers []chan DoorState
+}
+
+// NewRatgdoDriver builds the MQTT client used to reach the ratgdo device,
+// but does not connect it. Call Start once every Subscribe call has
+// registered, so a state pushed immediately on connect is never dropped.
+// qos is applied to the status subscribe and command publish.
+func NewRatgdoDriver(config DoorConfig, qos byte, log *logging.Logger) *RatgdoDriver {
+	driver := &RatgdoDriver{
+		log:          log,
+		qos:          qos,
+		config:       config,
+		topicStatus:  fmt.Sprintf("ratgdo/%s/status/door", config.RatgdoID),
+		topicCommand: fmt.Sprintf("ratgdo/%s/command/door", config.RatgdoID),
+	}
+
+	clientOptions := mqtt.NewClientOptions()
+	clientOptions.AddBroker(config.RatgdoMQTTServer)
+	clientOptions.SetUsername(config.RatgdoMQTTUsername)
+	clientOptions.SetPassword(config.RatgdoMQTTPassword)
+	clientOptions.SetClientID(config.RatgdoMQTTClientID)
+	clientOptions.SetAutoReconnect(true)
+	clientOptions.SetDefaultPublishHandler(func(client mqtt.Client, msg mqtt.Message) {
+		if msg.Topic() != driver.topicStatus {
+			return
+		}
+		state := driver.decodeState(string(msg.Payload()))
+		driver.mu.Lock()
+		subscribers := driver.subscribers
+		driver.mu.Unlock()
+		for _, ch := range subscribers {
+			ch <- state
+		}
+	})
+
+	driver.client = mqtt.NewClient(clientOptions)
+
+	return driver
+}
+
+// Start connects to the ratgdo broker and subscribes to its status topic in
+// the background, retrying both with backoff instead of failing fatally, so
+// one door's ratgdo broker being down (or coming up after the Pi does)
+// doesn't take down the other configured doors.
+func (driver *RatgdoDriver) Start() {
+	go func() {
+		connectWithBackoff(driver.client, driver.log)
+		driver.subscribeWithBackoff()
+	}()
+}
+
+// subscribeWithBackoff subscribes to the status topic, retrying with
+// exponential backoff and jitter instead of giving up on the first failure.
+func (driver *RatgdoDriver) subscribeWithBackoff() {
+	backoff := time.Second
+	const maxBackoff = 2 * time.Minute
+
+	for {
+		token := driver.client.Subscribe(driver.topicStatus, driver.qos, nil)
+		token.Wait()
+		if token.Error() == nil {
+			return
+		}
+
+		driver.log.Errorf("Unable to subscribe to ratgdo status topic '%s': %v (retrying in ~%v)", driver.topicStatus, token.Error(), backoff)
+		time.Sleep(backoff/2 + time.Duration(rand.Int63n(int64(backoff/2+1))))
+
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// Polls is false: the ratgdo device only pushes state, it is never polled.
+func (driver *RatgdoDriver) Polls() bool {
+	return false
+}
+
+func (driver *RatgdoDriver) decodeState(payload string) DoorState {
+	switch payload {
+	case "open":
+		return DoorOpen
+	case "closed":
+		return DoorClosed
+	case "opening":
+		return DoorOpening
+	case "closing":
+		return DoorClosing
+	}
+	return DoorUnknown
+}
+
+// ReadState is not backed by a local poll and always returns DoorUnknown;
+// the ratgdo device pushes its state over MQTT to the channels registered
+// via Subscribe instead. Polls reports false, so the controller's poll
+// loop does not use this value.
+func (driver *RatgdoDriver) ReadState() DoorState {
+	return DoorUnknown
+}
+
+// Trigger publishes the open/close command to the ratgdo command topic.
+func (driver *RatgdoDriver) Trigger(cmd string) error {
+	command := "close"
+	if cmd == "O" {
+		command = "open"
+	}
+	token := driver.client.Publish(driver.topicCommand, driver.qos, false, command)
+	token.Wait()
+	return token.Error()
+}
+
+// Subscribe registers ch to receive state updates pushed from the ratgdo
+// status topic. Call this before Start, so an update pushed immediately on
+// connect is not dropped.
+func (driver *RatgdoDriver) Subscribe(ch chan DoorState) {
+	driver.mu.Lock()
+	defer driver.mu.Unlock()
+	driver.subscribers = append(driver.subscribers, ch)
+}
+
+// DryRunDriver simulates a door entirely in memory, so the daemon can be
+// exercised on hardware without a Pi's GPIO header.
+type DryRunDriver struct {
+	log   *logging.Logger
+	state DoorState
+}
+
+// NewDryRunDriver creates a DryRunDriver starting in the closed state.
+func NewDryRunDriver(log *logging.Logger) *DryRunDriver {
+	return &DryRunDriver{
+		log:   log,
+		state: DoorClosed,
+	}
+}
+
+// ReadState returns the simulated door state.
+func (driver *DryRunDriver) ReadState() DoorState {
+	return driver.state
+}
+
+// Trigger flips the simulated door state and logs the command instead of
+// driving any hardware.
+func (driver *DryRunDriver) Trigger(cmd string) error {
+	driver.log.Infof("dry-run: triggering door with command %q", cmd)
+	if cmd == "O" {
+		driver.state = DoorOpen
+	} else {
+		driver.state = DoorClosed
+	}
+	return nil
+}
+
+// Subscribe is a no-op: the dry-run driver has no push source.
+func (driver *DryRunDriver) Subscribe(ch chan DoorState) {
+}
+
+// Start is a no-op: the dry-run driver has nothing to connect.
+func (driver *DryRunDriver) Start() {
+}
+
+// Polls is true: ReadState reads the simulated state live on every call.
+func (driver *DryRunDriver) Polls() bool {
+	return true
+}
+
+// newDoorDriver builds the DoorDriver selected by config.Driver. An empty
+// value defaults to "gpio" so existing configuration files keep working.
+// qos is applied to any Publish/Subscribe calls the driver makes of its
+// own (e.g. the ratgdo driver's second broker connection).
+func newDoorDriver(config DoorConfig, qos byte, log *logging.Logger) (DoorDriver, error) {
+	switch config.Driver {
+	case "", "gpio":
+		return NewGPIODriver(config.PinStatus, config.PinControl), nil
+	case "ratgdo":
+		return NewRatgdoDriver(config, qos, log), nil
+	case "dryrun":
+		return NewDryRunDriver(log), nil
+	}
+	return nil, fmt.Errorf("unknown driver %q", config.Driver)
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"flag"
+	"sync"
+
 	"github.com/BurntSushi/toml"
 	"github.com/eclipse/paho.mqtt.golang"
 	"github.com/op/go-logging"
@@ -9,20 +11,99 @@ import (
 	"time"
 )
 
-// GarageControllerConfig represents all startup configuration for a garage controller
-type GarageControllerConfig struct {
+// Config represents all startup configuration for the controller daemon.
+// A single MQTT connection is shared by every door in Doors.
+type Config struct {
 	MQTTServer        string
 	MQTTUsername      string
 	MQTTPassword      string
 	MQTTClientID      string
 	MQTTTopicPresence string
-	MQTTTopicControl  string
-	MQTTTopicStatus   string
-	TravelDelay       int
-	PinStatus         int
-	PinControl        int
+	Doors             []DoorConfig `toml:"doors"`
+
+	// MQTTTLSCA, MQTTTLSCert, and MQTTTLSKey configure TLS (and, if a
+	// cert/key pair is given, mutual TLS) to the broker. Leaving all three
+	// empty (and MQTTInsecureSkipVerify false) keeps the connection plain.
+	MQTTTLSCA              string
+	MQTTTLSCert            string
+	MQTTTLSKey             string
+	MQTTInsecureSkipVerify bool
+
+	// MQTTQoS is applied uniformly to every Publish/Subscribe call.
+	MQTTQoS byte
+	// MQTTWillRetain controls whether the presence Last Will is retained.
+	MQTTWillRetain bool
+	// MQTTCleanSession and MQTTKeepAliveSec configure the session; a zero
+	// MQTTKeepAliveSec leaves the client library's default in effect.
+	MQTTCleanSession bool
+	MQTTKeepAliveSec int
+
+	// MetricsAddr, if non-empty, serves Prometheus metrics at /metrics on
+	// this address (e.g. ":9100").
+	MetricsAddr string
+}
+
+// DoorConfig represents the configuration for a single garage door.
+type DoorConfig struct {
+	Name             string
+	MQTTTopicControl string
+	MQTTTopicStatus  string
+	TravelDelay      int
+
+	// MQTTTopicControlHomeKit, if set, is subscribed alongside
+	// MQTTTopicControl and is the topic the HomeKit bridge publishes to
+	// instead of MQTTTopicControl, so commands arriving there are logged
+	// with source "homekit" rather than "mqtt". Leaving it empty keeps
+	// HomeKit and raw MQTT commands on the same topic, indistinguishable
+	// as source "mqtt".
+	MQTTTopicControlHomeKit string
+
+	// AutoRecloseSeconds, if non-zero, automatically resets and retries
+	// CloseDoor this many seconds after the door becomes obstructed.
+	AutoRecloseSeconds int
+
+	// Driver selects the DoorDriver implementation: "gpio" (default),
+	// "ratgdo", or "dryrun".
+	Driver string
+
+	// PinStatus and PinControl are used by the "gpio" driver.
+	PinStatus  int
+	PinControl int
+
+	// Ratgdo* fields are used by the "ratgdo" driver, which talks to an
+	// existing MQTT-native door opener, possibly on a different broker
+	// than the controller's own MQTTServer.
+	RatgdoMQTTServer   string
+	RatgdoMQTTUsername string
+	RatgdoMQTTPassword string
+	RatgdoMQTTClientID string
+	RatgdoID           string
+
+	// HADiscovery, when true, publishes a retained Home Assistant MQTT
+	// Discovery config for this door as a "cover" device on connect.
+	HADiscovery bool
+	// HADeviceID is the unique id used in the discovery topic
+	// (homeassistant/cover/<id>/config) and as the device's unique_id.
+	// Defaults to Name, trimmed and lowercased with spaces replaced by
+	// underscores, if empty.
+	HADeviceID string
+
+	// StatusFormat selects "legacy" (default, a single-character payload
+	// on MQTTTopicStatus) or "json", which additionally publishes a JSON
+	// status payload on MQTTTopicStatusJSON alongside the legacy payload.
+	StatusFormat        string
+	MQTTTopicStatusJSON string
 }
 
+// presenceOnline and presenceOffline are published to MQTTTopicPresence to
+// announce the daemon's availability, and are also wired into each door's
+// Home Assistant discovery config as payload_available/payload_not_available
+// so HA's cover entity tracks the same values.
+const (
+	presenceOnline  = "GBP-ONLINE"
+	presenceOffline = "GBP-OFFLINE"
+)
+
 // DoorState represents the state of the garage door
 type DoorState uint8
 
@@ -32,6 +113,7 @@ const (
 	DoorClosed
 	DoorOpening
 	DoorClosing
+	DoorObstructed
 	DoorUnknown
 )
 
@@ -45,146 +127,224 @@ func (state DoorState) String() string {
 		return "Opening"
 	case DoorClosing:
 		return "Closing"
+	case DoorObstructed:
+		return "Obstructed"
 	}
 	return "Unknown"
 }
 
-// GarageController handles door state and messaging to MQTT
+// GarageController handles door state and messaging to MQTT. currentDoorState,
+// stateSince, movingStatus, obstructed, and travelStart are read and written
+// from multiple goroutines (Run, the MQTT control callback, and monitorTravel/
+// autoReclose) and are guarded by mu; every other field is set once at
+// construction and never modified after.
 type GarageController struct {
-	currentDoorState    DoorState
-	movingStatus        bool
-	client              mqtt.Client
-	config              GarageControllerConfig
-	log                 *logging.Logger
-	movingStatusChannel chan bool      // channel for communicating if door is still movingStatus
-	statusChannel       chan DoorState // channel for communicating current status of door
-	pinStatus           rpio.Pin
-	pinControl          rpio.Pin
+	mu               sync.Mutex
+	currentDoorState DoorState
+	stateSince       time.Time // when currentDoorState was last entered, for the "since" field in jsonStatus
+	movingStatus     bool
+	obstructed       bool
+	travelStart      time.Time // when the current Opening/Closing travel began, for gbp_door_travel_seconds
+
+	client        mqtt.Client
+	qos           byte
+	config        DoorConfig
+	log           *logging.Logger
+	statusChannel chan DoorState    // channel for communicating current status of door
+	travelChannel chan travelResult // channel for reporting the outcome of a travel watch
+	driver        DoorDriver
 }
 
-// NewGarageController creates a new Garage Controller from a configuration and logging object
-func NewGarageController(config GarageControllerConfig, log *logging.Logger) *GarageController {
-
-	pinStatus := rpio.Pin(config.PinStatus)
-	pinStatus.Mode(rpio.Input)
-	pinStatus.Pull(rpio.PullDown)
+// NewGarageController creates a new Garage Controller for one door, using
+// the given shared MQTT client and logging object. presenceTopic is the
+// daemon-wide presence topic, used as the availability_topic for this
+// door's Home Assistant discovery config. qos is applied to every
+// Publish/Subscribe call the controller makes on client.
+func NewGarageController(config DoorConfig, client mqtt.Client, qos byte, presenceTopic string, log *logging.Logger) *GarageController {
 
-	pinControl := rpio.Pin(config.PinControl)
-	pinControl.Mode(rpio.Output)
+	driver, err := newDoorDriver(config, qos, log)
+	if err != nil {
+		log.Fatalf("Unable to create door driver for '%s': %v", config.Name, err)
+	}
 
 	controller := GarageController{
-		config:              config,
-		movingStatus:        false,
-		log:                 log,
-		currentDoorState:    DoorUnknown,
-		movingStatusChannel: make(chan bool),
-		statusChannel:       make(chan DoorState),
-		pinControl:          pinControl,
-		pinStatus:           pinStatus,
+		config:           config,
+		movingStatus:     false,
+		log:              log,
+		currentDoorState: DoorUnknown,
+		statusChannel:    make(chan DoorState),
+		travelChannel:    make(chan travelResult),
+		client:           client,
+		qos:              qos,
+		driver:           driver,
 	}
 
-	clientOptions := mqtt.NewClientOptions()
-	clientOptions.AddBroker(config.MQTTServer)
-	clientOptions.SetUsername(config.MQTTUsername)
-	clientOptions.SetPassword(config.MQTTPassword)
-	clientOptions.SetClientID(config.MQTTClientID)
-	clientOptions.SetAutoReconnect(true)
-	clientOptions.SetWill(config.MQTTTopicPresence, "GBP-OFFLINE", 0, false)
-	clientOptions.SetDefaultPublishHandler(func(client mqtt.Client, msg mqtt.Message) {
-		if msg.Topic() == config.MQTTTopicControl && !controller.movingStatus {
-			switch string(msg.Payload()) {
-			case "O":
-				controller.OpenDoor()
-			case "C":
-				controller.CloseDoor()
-			}
-		}
-	})
-
-	controller.client = mqtt.NewClient(clientOptions)
-	if token := controller.client.Connect(); token.Wait() && token.Error() != nil {
-		controller.log.Fatalf("Unable to connect to '%s': %v", config.MQTTServer, token.Error())
-	}
+	driver.Subscribe(controller.statusChannel)
+	driver.Start()
 
-	if token := controller.client.Publish(config.MQTTTopicPresence, 0, false, "GBP-ONLINE"); token.Wait() && token.Error() != nil {
-		controller.log.Fatalf("Unable to publish presence '%s': %v", config.MQTTServer, token.Error())
+	controller.subscribeControl(config.MQTTTopicControl, "mqtt")
+	if config.MQTTTopicControlHomeKit != "" {
+		controller.subscribeControl(config.MQTTTopicControlHomeKit, "homekit")
 	}
 
-	if token := controller.client.Subscribe(config.MQTTTopicControl, 0, nil); token.Wait() && token.Error() != nil {
-		controller.log.Fatalf("Unable to subscribe to control topic '%s': %v", config.MQTTTopicControl, token.Error())
-	}
+	controller.publishDiscovery(presenceTopic)
 
-	controller.setState(controller.readState())
+	controller.setState(controller.readState(), "poll")
 
 	return &controller
 }
 
-// readState pulls the status of the garage door unless the door is currently movingStatus.  Then we return the current status
-func (controller *GarageController) readState() DoorState {
-	if controller.movingStatus {
-		return controller.currentDoorState
+// subscribeControl subscribes topic for "O"/"C"/"R" door commands, tagging
+// every command handled from it with source for the event log.
+func (controller *GarageController) subscribeControl(topic string, source string) {
+	if token := controller.client.Subscribe(topic, controller.qos, func(c mqtt.Client, msg mqtt.Message) {
+		if controller.isMoving() {
+			return
+		}
+		switch string(msg.Payload()) {
+		case "O":
+			controller.OpenDoor(source)
+		case "C":
+			controller.CloseDoor(source)
+		case "R":
+			controller.reset(source)
+		}
+	}); token.Wait() && token.Error() != nil {
+		controller.log.Fatalf("Unable to subscribe to control topic '%s': %v", topic, token.Error())
 	}
+}
 
-	if rpio.ReadPin(controller.pinStatus) == rpio.High {
-		return DoorOpen
+// isMoving reports whether the door is currently between a terminal state,
+// i.e. an Open/Close has been triggered and monitorTravel hasn't reported
+// back yet.
+func (controller *GarageController) isMoving() bool {
+	controller.mu.Lock()
+	defer controller.mu.Unlock()
+	return controller.movingStatus
+}
+
+// readState pulls the status of the garage door unless the door is
+// currently movingStatus or obstructed (so DoorObstructed holds until an
+// explicit reset), or the driver is push-only (e.g. ratgdo), in which case
+// ReadState cannot be trusted and the last pushed state is returned
+// instead. Then we return the current status
+func (controller *GarageController) readState() DoorState {
+	controller.mu.Lock()
+	moving := controller.movingStatus
+	obstructed := controller.obstructed
+	current := controller.currentDoorState
+	controller.mu.Unlock()
+
+	if moving || obstructed || !controller.driver.Polls() {
+		return current
 	}
 
-	return DoorClosed
+	return controller.driver.ReadState()
 }
 
-func (controller *GarageController) setState(newState DoorState) {
+// setState transitions the door to newState, recording metrics, emitting
+// a structured transition event, and publishing the new status over MQTT.
+// source identifies what triggered the transition ("mqtt", "poll", ...)
+// for the event log.
+func (controller *GarageController) setState(newState DoorState, source string) {
+	controller.mu.Lock()
 	if controller.currentDoorState == newState {
+		controller.mu.Unlock()
 		return
 	}
-	controller.log.Infof("Door state from %v to %v", controller.currentDoorState, newState)
+	previous := controller.currentDoorState
 	controller.currentDoorState = newState
-	switch controller.currentDoorState {
+	controller.stateSince = time.Now()
+
+	switch newState {
+	case DoorOpening, DoorClosing:
+		controller.travelStart = time.Now()
+	}
+
+	var travelSeconds *float64
+	switch newState {
+	case DoorOpen, DoorClosed, DoorObstructed:
+		if !controller.travelStart.IsZero() {
+			seconds := time.Since(controller.travelStart).Seconds()
+			travelSeconds = &seconds
+			doorTravelSeconds.WithLabelValues(controller.config.Name).Observe(seconds)
+			controller.travelStart = time.Time{}
+		}
+	}
+	controller.mu.Unlock()
+
+	controller.log.Infof("Door '%s' state from %v to %v", controller.config.Name, previous, newState)
+
+	doorTransitionsTotal.WithLabelValues(controller.config.Name, previous.String(), newState.String()).Inc()
+	setDoorStateGauge(controller.config.Name, newState)
+	if newState == DoorObstructed {
+		obstructionsTotal.WithLabelValues(controller.config.Name).Inc()
+	}
+
+	switch newState {
 	case DoorOpen:
-		controller.client.Publish(controller.config.MQTTTopicStatus, 0, true, "O")
+		controller.publish(controller.config.MQTTTopicStatus, true, "O")
 	case DoorClosed:
-		controller.client.Publish(controller.config.MQTTTopicStatus, 0, true, "C")
+		controller.publish(controller.config.MQTTTopicStatus, true, "C")
 	case DoorOpening:
-		controller.client.Publish(controller.config.MQTTTopicStatus, 0, true, "U")
+		controller.publish(controller.config.MQTTTopicStatus, true, "U")
 	case DoorClosing:
-		controller.client.Publish(controller.config.MQTTTopicStatus, 0, true, "D")
+		controller.publish(controller.config.MQTTTopicStatus, true, "D")
+	case DoorObstructed:
+		controller.publish(controller.config.MQTTTopicStatus, true, "X")
+	}
+	controller.publishJSONStatus()
+	controller.logTransition(previous, newState, source, travelSeconds)
+}
+
+// publish publishes payload to topic at the controller's configured QoS,
+// counting any failure toward gbp_mqtt_publish_errors_total.
+func (controller *GarageController) publish(topic string, retain bool, payload interface{}) {
+	if token := controller.client.Publish(topic, controller.qos, retain, payload); token.Wait() && token.Error() != nil {
+		controller.log.Errorf("Unable to publish to '%s': %v", topic, token.Error())
+		mqttPublishErrorsTotal.Inc()
 	}
 }
 
-func (controller *GarageController) toggleDoor() {
-	controller.log.Debug("Toggling door")
-	rpio.WritePin(controller.pinControl, rpio.High)
-	time.Sleep(250 * time.Millisecond)
-	rpio.WritePin(controller.pinControl, rpio.Low)
+func (controller *GarageController) triggerDoor(cmd string) {
+	controller.log.Debug("Triggering door")
+	if err := controller.driver.Trigger(cmd); err != nil {
+		controller.log.Errorf("Unable to trigger door: %v", err)
+	}
 }
 
-// OpenDoor opens the door
-func (controller *GarageController) OpenDoor() {
+// OpenDoor opens the door. source identifies what triggered the open for
+// the event log (e.g. "mqtt", "poll").
+func (controller *GarageController) OpenDoor(source string) {
+	controller.mu.Lock()
 	if controller.currentDoorState != DoorClosed {
+		controller.mu.Unlock()
 		return
 	}
-	controller.log.Info("Opening Door")
 	controller.movingStatus = true
-	controller.setState(DoorOpening)
-	controller.toggleDoor()
-	go func(ch chan<- bool) {
-		time.Sleep(time.Duration(controller.config.TravelDelay) * time.Second)
-		ch <- false
-	}(controller.movingStatusChannel)
+	controller.mu.Unlock()
+
+	controller.log.Info("Opening Door")
+	controller.setState(DoorOpening, source)
+	controller.triggerDoor("O")
+	go controller.monitorTravel(DoorOpen)
 }
 
-// CloseDoor closes the door
-func (controller *GarageController) CloseDoor() {
+// CloseDoor closes the door. source identifies what triggered the close
+// for the event log (e.g. "mqtt", "poll").
+func (controller *GarageController) CloseDoor(source string) {
+	controller.mu.Lock()
 	if controller.currentDoorState != DoorOpen {
+		controller.mu.Unlock()
 		return
 	}
-	controller.log.Info("Closing Door")
 	controller.movingStatus = true
-	controller.setState(DoorClosing)
-	controller.toggleDoor()
-	go func(ch chan<- bool) {
-		time.Sleep(time.Duration(controller.config.TravelDelay) * time.Second)
-		ch <- false
-	}(controller.movingStatusChannel)
+	controller.mu.Unlock()
+
+	controller.log.Info("Closing Door")
+	controller.setState(DoorClosing, source)
+	controller.triggerDoor("C")
+	go controller.monitorTravel(DoorClosed)
 }
 
 // Run invoke the main controller loop
@@ -194,35 +354,114 @@ func (controller *GarageController) Run() {
 	for {
 
 		// if the door isn't moving, check the status
-		if !controller.movingStatus {
-			controller.setState(controller.readState())
+		if !controller.isMoving() {
+			controller.setState(controller.readState(), "poll")
 		}
 
 		select {
-		case moving := <-controller.movingStatusChannel:
-			controller.movingStatus = moving
+		case result := <-controller.travelChannel:
+			controller.mu.Lock()
+			controller.movingStatus = false
+			controller.mu.Unlock()
+			if result == travelObstructed {
+				controller.setObstructed("poll")
+			}
+		case state := <-controller.statusChannel:
+			// pushed by drivers with no local poll source (e.g. ratgdo)
+			controller.setState(state, "poll")
 		default:
 			time.Sleep(50 * time.Millisecond)
 		}
 	}
 }
 
-func main() {
-	if err := rpio.Open(); err != nil {
-		panic(err)
+// newMQTTClient connects the single MQTT client shared by every configured
+// door and announces the daemon's presence.
+func newMQTTClient(config Config, log *logging.Logger) mqtt.Client {
+	clientOptions := mqtt.NewClientOptions()
+	clientOptions.AddBroker(config.MQTTServer)
+	clientOptions.SetUsername(config.MQTTUsername)
+	clientOptions.SetPassword(config.MQTTPassword)
+	clientOptions.SetClientID(config.MQTTClientID)
+	clientOptions.SetAutoReconnect(true)
+	clientOptions.SetCleanSession(config.MQTTCleanSession)
+	clientOptions.SetWill(config.MQTTTopicPresence, presenceOffline, config.MQTTQoS, config.MQTTWillRetain)
+
+	connected := false
+	clientOptions.SetOnConnectHandler(func(c mqtt.Client) {
+		if connected {
+			mqttReconnectsTotal.Inc()
+		}
+		connected = true
+	})
+	if config.MQTTKeepAliveSec > 0 {
+		clientOptions.SetKeepAlive(time.Duration(config.MQTTKeepAliveSec) * time.Second)
 	}
-	defer rpio.Close()
 
+	tlsConfig, err := buildTLSConfig(config)
+	if err != nil {
+		log.Fatalf("Invalid MQTT TLS configuration: %v", err)
+	}
+	if tlsConfig != nil {
+		clientOptions.SetTLSConfig(tlsConfig)
+	}
+
+	client := mqtt.NewClient(clientOptions)
+	connectWithBackoff(client, log)
+
+	// Retained, so Home Assistant (and anything else subscribing to
+	// MQTTTopicPresence as an availability_topic) sees the daemon as
+	// available immediately on subscribe rather than staying "unavailable"
+	// until the next presence change.
+	if token := client.Publish(config.MQTTTopicPresence, config.MQTTQoS, true, presenceOnline); token.Wait() && token.Error() != nil {
+		log.Fatalf("Unable to publish presence '%s': %v", config.MQTTServer, token.Error())
+	}
+
+	return client
+}
+
+// needsGPIO reports whether any configured door uses the "gpio" driver
+// (the default), which is the only driver that touches the Pi's GPIO
+// header.
+func needsGPIO(doors []DoorConfig) bool {
+	for _, door := range doors {
+		if door.Driver == "" || door.Driver == "gpio" {
+			return true
+		}
+	}
+	return false
+}
+
+func main() {
 	log := logging.MustGetLogger("loader")
 
 	configPath := flag.String("c", "controller.config", "Controller configuration file")
 	flag.Parse()
 
-	var config GarageControllerConfig
+	var config Config
 	if _, err := toml.DecodeFile(*configPath, &config); err != nil {
 		log.Fatalf("Error loading configuration: %v", err)
 	}
 
-	controller := NewGarageController(config, log)
-	controller.Run()
+	if needsGPIO(config.Doors) {
+		if err := rpio.Open(); err != nil {
+			panic(err)
+		}
+		defer rpio.Close()
+	}
+
+	startMetricsServer(config.MetricsAddr, log)
+
+	client := newMQTTClient(config, log)
+
+	var wg sync.WaitGroup
+	for _, door := range config.Doors {
+		controller := NewGarageController(door, client, config.MQTTQoS, config.MQTTTopicPresence, log)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			controller.Run()
+		}()
+	}
+	wg.Wait()
 }
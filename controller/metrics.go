@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/op/go-logging"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	doorStateGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "gbp_door_state",
+		Help: "1 for the door's current state, 0 otherwise, labeled by door and state.",
+	}, []string{"door", "state"})
+
+	doorTransitionsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gbp_door_transitions_total",
+		Help: "Total number of door state transitions, labeled by door, from, and to.",
+	}, []string{"door", "from", "to"})
+
+	doorTravelSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "gbp_door_travel_seconds",
+		Help: "Observed time for a door to finish opening or closing, labeled by door.",
+		// Real garage doors take roughly 10-20s to fully open or close;
+		// DefBuckets tops out at 10s and would dump almost every
+		// observation into +Inf. 2s..30s in 2s steps covers the expected
+		// range plus slow/stuck doors.
+		Buckets: prometheus.LinearBuckets(2, 2, 15),
+	}, []string{"door"})
+
+	mqttReconnectsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "gbp_mqtt_reconnects_total",
+		Help: "Total number of times the shared MQTT client has reconnected after the initial connect.",
+	})
+
+	mqttPublishErrorsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "gbp_mqtt_publish_errors_total",
+		Help: "Total number of MQTT publish attempts that returned an error.",
+	})
+
+	obstructionsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gbp_obstructions_total",
+		Help: "Total number of times a door has been detected as obstructed, labeled by door.",
+	}, []string{"door"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		doorStateGauge,
+		doorTransitionsTotal,
+		doorTravelSeconds,
+		mqttReconnectsTotal,
+		mqttPublishErrorsTotal,
+		obstructionsTotal,
+	)
+}
+
+// setDoorStateGauge sets gbp_door_state to 1 for state and 0 for every
+// other possible state of door, so the gauge is a one-hot encoding usable
+// directly in a Grafana table.
+func setDoorStateGauge(door string, state DoorState) {
+	for _, s := range []DoorState{DoorOpen, DoorClosed, DoorOpening, DoorClosing, DoorObstructed, DoorUnknown} {
+		value := 0.0
+		if s == state {
+			value = 1.0
+		}
+		doorStateGauge.WithLabelValues(door, s.String()).Set(value)
+	}
+}
+
+// startMetricsServer serves Prometheus metrics at /metrics on addr. It is a
+// no-op if addr is empty.
+func startMetricsServer(addr string, log *logging.Logger) {
+	if addr == "" {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Errorf("Metrics server on '%s' exited: %v", addr, err)
+		}
+	}()
+}
+
+// transitionEvent is a structured JSON event logged once per door state
+// transition, for consumption by log shippers that don't parse free-text
+// log lines.
+type transitionEvent struct {
+	Timestamp     time.Time `json:"timestamp"`
+	Door          string    `json:"door"`
+	PreviousState string    `json:"previous_state"`
+	NewState      string    `json:"new_state"`
+	Source        string    `json:"source"`
+	TravelSeconds *float64  `json:"travel_seconds,omitempty"`
+}
+
+// logTransition emits a transitionEvent as a JSON log line. source
+// identifies what triggered the transition ("mqtt", "homekit" when the
+// door's MQTTTopicControlHomeKit is configured, or "poll"); travelSeconds
+// is non-nil only when the transition completes a travel (i.e. landed on
+// DoorOpen, DoorClosed, or DoorObstructed).
+func (controller *GarageController) logTransition(previous, newState DoorState, source string, travelSeconds *float64) {
+	event := transitionEvent{
+		Timestamp:     time.Now(),
+		Door:          controller.config.Name,
+		PreviousState: previous.String(),
+		NewState:      newState.String(),
+		Source:        source,
+		TravelSeconds: travelSeconds,
+	}
+
+	body, err := json.Marshal(event)
+	if err != nil {
+		controller.log.Errorf("Unable to marshal transition event for '%s': %v", controller.config.Name, err)
+		return
+	}
+	controller.log.Info(string(body))
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang"
+	"github.com/op/go-logging"
+)
+
+// buildTLSConfig builds a *tls.Config from the MQTTTLS* fields and
+// MQTTInsecureSkipVerify, or returns nil if none of them are set, leaving
+// the connection unencrypted.
+func buildTLSConfig(config Config) (*tls.Config, error) {
+	if config.MQTTTLSCA == "" && config.MQTTTLSCert == "" && config.MQTTTLSKey == "" && !config.MQTTInsecureSkipVerify {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: config.MQTTInsecureSkipVerify,
+	}
+
+	if config.MQTTTLSCA != "" {
+		ca, err := ioutil.ReadFile(config.MQTTTLSCA)
+		if err != nil {
+			return nil, fmt.Errorf("reading MQTTTLSCA: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates found in MQTTTLSCA %q", config.MQTTTLSCA)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if config.MQTTTLSCert != "" || config.MQTTTLSKey != "" {
+		cert, err := tls.LoadX509KeyPair(config.MQTTTLSCert, config.MQTTTLSKey)
+		if err != nil {
+			return nil, fmt.Errorf("loading MQTTTLSCert/MQTTTLSKey: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// connectWithBackoff connects client, retrying with exponential backoff
+// and jitter instead of giving up on the first failure, so the daemon
+// survives a broker that comes up after the Pi does.
+func connectWithBackoff(client mqtt.Client, log *logging.Logger) {
+	backoff := time.Second
+	const maxBackoff = 2 * time.Minute
+
+	for {
+		token := client.Connect()
+		token.Wait()
+		if token.Error() == nil {
+			return
+		}
+
+		log.Errorf("Unable to connect to MQTT broker: %v (retrying in ~%v)", token.Error(), backoff)
+		time.Sleep(backoff/2 + time.Duration(rand.Int63n(int64(backoff/2+1))))
+
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
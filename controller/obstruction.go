@@ -0,0 +1,89 @@
+package main
+
+import "time"
+
+// travelResult reports the outcome of watching a door's travel for the
+// expected terminal state.
+type travelResult int
+
+// Possible outcomes of a travel watch.
+const (
+	travelComplete travelResult = iota
+	travelObstructed
+)
+
+// monitorTravel polls for expected to be reached before TravelDelay
+// elapses, reporting the outcome on travelChannel. It checks both
+// driver.ReadState() (for polling drivers, which readState() will not
+// do itself while movingStatus is set) and currentDoorState (kept up to
+// date by Run for push drivers like ratgdo, whose ReadState() cannot
+// report progress on its own).
+func (controller *GarageController) monitorTravel(expected DoorState) {
+	deadline := time.Now().Add(time.Duration(controller.config.TravelDelay) * time.Second)
+
+	for {
+		state := controller.driver.ReadState()
+		controller.mu.Lock()
+		current := controller.currentDoorState
+		controller.mu.Unlock()
+
+		if state == expected || current == expected {
+			controller.travelChannel <- travelComplete
+			return
+		}
+		if !time.Now().Before(deadline) {
+			controller.travelChannel <- travelObstructed
+			return
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+}
+
+// setObstructed transitions the door to DoorObstructed and, if configured,
+// schedules an auto-reclose attempt. source identifies what detected the
+// obstruction, for the event log.
+func (controller *GarageController) setObstructed(source string) {
+	controller.mu.Lock()
+	controller.obstructed = true
+	controller.mu.Unlock()
+
+	controller.setState(DoorObstructed, source)
+
+	if controller.config.AutoRecloseSeconds > 0 {
+		go controller.autoReclose()
+	}
+}
+
+// reset clears an obstruction so the relay can be triggered again. It is
+// invoked by an explicit "R" command on the control topic, since
+// OpenDoor/CloseDoor refuse to re-trigger while obstructed. source
+// identifies what triggered the reset, for the event log.
+func (controller *GarageController) reset(source string) {
+	controller.mu.Lock()
+	if !controller.obstructed {
+		controller.mu.Unlock()
+		return
+	}
+	controller.obstructed = false
+	controller.mu.Unlock()
+
+	controller.log.Infof("Door '%s' obstruction reset", controller.config.Name)
+	controller.setState(controller.driver.ReadState(), source)
+}
+
+// autoReclose waits AutoRecloseSeconds after an obstruction and, if the
+// door is still obstructed, resets and retries closing it.
+func (controller *GarageController) autoReclose() {
+	time.Sleep(time.Duration(controller.config.AutoRecloseSeconds) * time.Second)
+
+	controller.mu.Lock()
+	state := controller.currentDoorState
+	controller.mu.Unlock()
+	if state != DoorObstructed {
+		return
+	}
+
+	controller.log.Infof("Door '%s' auto-reclosing after obstruction", controller.config.Name)
+	controller.reset("poll")
+	controller.CloseDoor("poll")
+}
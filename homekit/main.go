@@ -2,6 +2,8 @@ package main
 
 import (
 	"flag"
+	"fmt"
+	"time"
 
 	"github.com/BurntSushi/toml"
 	"github.com/brutella/hc"
@@ -9,117 +11,230 @@ import (
 	"github.com/brutella/hc/characteristic"
 	"github.com/brutella/hc/service"
 	hklog "github.com/brutella/log"
-	"github.com/op/go-logging"
 	"github.com/eclipse/paho.mqtt.golang"
+	"github.com/op/go-logging"
 )
 
-type HomeKitConfig struct {
+// Config represents all startup configuration for the HomeKit bridge,
+// exposing one GarageDoorOpener accessory per configured door.
+type Config struct {
 	MQTTServer        string
 	MQTTUsername      string
 	MQTTPassword      string
 	MQTTClientID      string
 	MQTTTopicPresence string
-	MQTTTopicControl  string
-	MQTTTopicStatus   string
 	HomeKitName       string
 	HomeKitPIN        string
 	HomeKitSerial     string
-}
+	Doors             []DoorConfig `toml:"doors"`
 
-type HomeKitController struct {
-	Log       *logging.Logger
-	Config    HomeKitConfig
-	Accessory *accessory.Accessory
-	Opener    *service.GarageDoorOpener
-	Client mqtt.Client
-}
+	// MQTTTLSCA, MQTTTLSCert, and MQTTTLSKey configure TLS (and, if a
+	// cert/key pair is given, mutual TLS) to the broker. Leaving all three
+	// empty (and MQTTInsecureSkipVerify false) keeps the connection plain.
+	MQTTTLSCA              string
+	MQTTTLSCert            string
+	MQTTTLSKey             string
+	MQTTInsecureSkipVerify bool
 
-func (controller *HomeKitController) Start() {
-	if token := controller.Client.Connect(); token.Wait() && token.Error() != nil {
-		controller.Log.Fatalf("Unable to connect to '%s': %v", controller.Config.MQTTServer, token.Error())
-	}
-
-	if token := controller.Client.Publish(controller.Config.MQTTTopicPresence, 0, false, "GBP-HOMEKIT-ONLINE"); token.Wait() && token.Error() != nil {
-		controller.Log.Fatalf("Unable to publish presence '%s': %v", controller.Config.MQTTServer, token.Error())
-	}
+	// MQTTQoS is applied uniformly to every Publish/Subscribe call.
+	MQTTQoS byte
+	// MQTTWillRetain controls whether the presence Last Will is retained.
+	MQTTWillRetain bool
+	// MQTTCleanSession and MQTTKeepAliveSec configure the session; a zero
+	// MQTTKeepAliveSec leaves the client library's default in effect.
+	MQTTCleanSession bool
+	MQTTKeepAliveSec int
+}
 
-	if token := controller.Client.Subscribe(controller.Config.MQTTTopicStatus, 0, nil); token.Wait() && token.Error() != nil {
-		controller.Log.Fatalf("Unable to subscribe to status topic '%s': %v", controller.Config.MQTTTopicStatus, token.Error())
-	}
+// DoorConfig represents the HomeKit-facing configuration for a single
+// garage door.
+type DoorConfig struct {
+	Name             string
+	MQTTTopicControl string
+	MQTTTopicStatus  string
 
-	t, err := hc.NewIPTransport(hc.Config{Pin: controller.Config.HomeKitPIN}, controller.Accessory)
-	if err != nil {
-		controller.Log.Fatal(err)
-	}
+	// MQTTTopicControlHomeKit, if set, is published to instead of
+	// MQTTTopicControl, so the controller can tell HomeKit-originated
+	// commands apart from raw MQTT commands on MQTTTopicControl. Must
+	// match the door's MQTTTopicControlHomeKit in the controller's config.
+	MQTTTopicControlHomeKit string
+}
 
-	hc.OnTermination(t.Stop)
-	t.Start()
+// DoorAccessory binds a single HomeKit GarageDoorOpener service to a
+// door's MQTT control/status topics on the bridge's shared MQTT client.
+type DoorAccessory struct {
+	Log       *logging.Logger
+	Config    DoorConfig
+	Client    mqtt.Client
+	QoS       byte
+	Accessory *accessory.Accessory
+	Opener    *service.GarageDoorOpener
 }
 
-func NewHomeKitController(config HomeKitConfig, log *logging.Logger) *HomeKitController {
+// NewDoorAccessory creates the HomeKit accessory for one door and wires
+// its control/status topics to the shared MQTT client. qos is applied to
+// every Publish/Subscribe call the accessory makes on client.
+func NewDoorAccessory(config DoorConfig, serial string, client mqtt.Client, qos byte, log *logging.Logger) *DoorAccessory {
 	info := accessory.Info{
-		Name:         config.HomeKitName,
+		Name:         config.Name,
 		Manufacturer: "Jeff Clement",
 		Model:        "GarageberryPi",
-		SerialNumber: config.HomeKitSerial,
+		SerialNumber: serial,
+	}
+
+	controlTopic := config.MQTTTopicControl
+	if config.MQTTTopicControlHomeKit != "" {
+		controlTopic = config.MQTTTopicControlHomeKit
 	}
 
-	controller := HomeKitController{
+	door := &DoorAccessory{
 		Config:    config,
 		Log:       log,
+		Client:    client,
+		QoS:       qos,
 		Accessory: accessory.New(info, accessory.TypeGarageDoorOpener),
 		Opener:    service.NewGarageDoorOpener(),
-		Client:    nil,
 	}
 
-	controller.Accessory.AddService(controller.Opener.Service)
-	controller.Opener.TargetDoorState.OnValueRemoteUpdate(func(value int) {
+	door.Accessory.AddService(door.Opener.Service)
+	door.Opener.TargetDoorState.OnValueRemoteUpdate(func(value int) {
 
 		code := ""
 		switch value {
 		case characteristic.TargetDoorStateOpen:
 			code = "O"
-			controller.Opener.CurrentDoorState.SetValue(characteristic.CurrentDoorStateOpen)
+			door.Opener.CurrentDoorState.SetValue(characteristic.CurrentDoorStateOpen)
 		case characteristic.TargetDoorStateClosed:
 			code = "C"
-			controller.Opener.CurrentDoorState.SetValue(characteristic.CurrentDoorStateClosed)
+			door.Opener.CurrentDoorState.SetValue(characteristic.CurrentDoorStateClosed)
 		}
 
 		if code != "" {
-			controller.Log.Debugf("Updating to %s", code)
-			if token := controller.Client.Publish(config.MQTTTopicControl, 0, false, code); token.Wait() && token.Error() != nil {
-				controller.Log.Fatalf("Unable to publish control message : %v", token.Error())
+			door.Log.Debugf("Updating '%s' to %s", config.Name, code)
+			if token := door.Client.Publish(controlTopic, door.QoS, false, code); token.Wait() && token.Error() != nil {
+				door.Log.Fatalf("Unable to publish control message : %v", token.Error())
 			}
 		}
 
 	})
 
+	return door
+}
+
+// subscribeStatus subscribes to the door's status topic, updating the
+// HomeKit characteristics as messages arrive. It must not be called until
+// after the shared MQTT client has connected: Subscribe on a disconnected
+// client fails immediately, so HomeKitBridge.Start calls this once
+// connectWithBackoff has succeeded rather than doing it at construction.
+func (door *DoorAccessory) subscribeStatus() {
+	if token := door.Client.Subscribe(door.Config.MQTTTopicStatus, door.QoS, func(c mqtt.Client, msg mqtt.Message) {
+		door.Log.Debugf("New status for '%s': %s", door.Config.Name, string(msg.Payload()))
+		switch string(msg.Payload()) {
+		case "O":
+			door.Opener.ObstructionDetected.SetValue(false)
+			door.Opener.CurrentDoorState.SetValue(characteristic.CurrentDoorStateOpen)
+		case "U":
+			door.Opener.ObstructionDetected.SetValue(false)
+			door.Opener.CurrentDoorState.SetValue(characteristic.CurrentDoorStateOpening)
+		case "D":
+			door.Opener.ObstructionDetected.SetValue(false)
+			door.Opener.CurrentDoorState.SetValue(characteristic.CurrentDoorStateClosing)
+		case "C":
+			door.Opener.ObstructionDetected.SetValue(false)
+			door.Opener.CurrentDoorState.SetValue(characteristic.CurrentDoorStateClosed)
+		case "X":
+			door.Opener.ObstructionDetected.SetValue(true)
+		}
+	}); token.Wait() && token.Error() != nil {
+		door.Log.Fatalf("Unable to subscribe to status topic '%s': %v", door.Config.MQTTTopicStatus, token.Error())
+	}
+}
+
+// HomeKitBridge hosts one DoorAccessory per configured door behind a
+// single HomeKit bridge accessory, sharing one MQTT client.
+type HomeKitBridge struct {
+	Log    *logging.Logger
+	Config Config
+	Bridge *accessory.Accessory
+	Doors  []*DoorAccessory
+	Client mqtt.Client
+}
+
+// NewHomeKitBridge builds the bridge accessory, the shared MQTT client, and
+// one DoorAccessory per configured door. The client is not connected here;
+// Start connects it.
+func NewHomeKitBridge(config Config, log *logging.Logger) *HomeKitBridge {
+	bridgeInfo := accessory.Info{
+		Name:         config.HomeKitName,
+		Manufacturer: "Jeff Clement",
+		Model:        "GarageberryPi",
+		SerialNumber: config.HomeKitSerial,
+	}
+
+	bridge := &HomeKitBridge{
+		Config: config,
+		Log:    log,
+		Bridge: accessory.NewBridge(bridgeInfo),
+	}
+
 	clientOptions := mqtt.NewClientOptions()
 	clientOptions.AddBroker(config.MQTTServer)
 	clientOptions.SetUsername(config.MQTTUsername)
 	clientOptions.SetPassword(config.MQTTPassword)
 	clientOptions.SetClientID(config.MQTTClientID)
 	clientOptions.SetAutoReconnect(true)
-	clientOptions.SetWill(config.MQTTTopicPresence, "GBP-HOMEKIT-OFFLINE", 0, false)
-	clientOptions.SetDefaultPublishHandler(func(client mqtt.Client, msg mqtt.Message) {
-		if msg.Topic() == config.MQTTTopicStatus {
-			controller.Log.Debugf("New status: %s", string(msg.Payload()))
-			switch string(msg.Payload()) {
-			case "O":
-				controller.Opener.CurrentDoorState.SetValue(characteristic.CurrentDoorStateOpen)
-			case "U":
-				controller.Opener.CurrentDoorState.SetValue(characteristic.CurrentDoorStateOpening)
-			case "D":
-				controller.Opener.CurrentDoorState.SetValue(characteristic.CurrentDoorStateClosing)
-			case "C":
-				controller.Opener.CurrentDoorState.SetValue(characteristic.CurrentDoorStateClosed)
-			}
+	clientOptions.SetCleanSession(config.MQTTCleanSession)
+	clientOptions.SetWill(config.MQTTTopicPresence, "GBP-HOMEKIT-OFFLINE", config.MQTTQoS, config.MQTTWillRetain)
+	if config.MQTTKeepAliveSec > 0 {
+		clientOptions.SetKeepAlive(time.Duration(config.MQTTKeepAliveSec) * time.Second)
+	}
+
+	tlsConfig, err := buildTLSConfig(config)
+	if err != nil {
+		log.Fatalf("Invalid MQTT TLS configuration: %v", err)
+	}
+	if tlsConfig != nil {
+		clientOptions.SetTLSConfig(tlsConfig)
+	}
+
+	bridge.Client = mqtt.NewClient(clientOptions)
+
+	for i, doorConfig := range config.Doors {
+		serial := config.HomeKitSerial
+		if len(config.Doors) > 1 {
+			serial = fmt.Sprintf("%s-%d", config.HomeKitSerial, i+1)
 		}
-	})
+		bridge.Doors = append(bridge.Doors, NewDoorAccessory(doorConfig, serial, bridge.Client, config.MQTTQoS, log))
+	}
+
+	return bridge
+}
+
+// Start connects to MQTT, announces presence, and starts serving the
+// bridge and its door accessories over HomeKit.
+func (bridge *HomeKitBridge) Start() {
+	connectWithBackoff(bridge.Client, bridge.Log)
+
+	for _, door := range bridge.Doors {
+		door.subscribeStatus()
+	}
+
+	if token := bridge.Client.Publish(bridge.Config.MQTTTopicPresence, bridge.Config.MQTTQoS, false, "GBP-HOMEKIT-ONLINE"); token.Wait() && token.Error() != nil {
+		bridge.Log.Fatalf("Unable to publish presence '%s': %v", bridge.Config.MQTTServer, token.Error())
+	}
+
+	accessories := make([]*accessory.Accessory, len(bridge.Doors))
+	for i, door := range bridge.Doors {
+		accessories[i] = door.Accessory
+	}
 
-	controller.Client = mqtt.NewClient(clientOptions)
+	t, err := hc.NewIPTransport(hc.Config{Pin: bridge.Config.HomeKitPIN}, bridge.Bridge, accessories...)
+	if err != nil {
+		bridge.Log.Fatal(err)
+	}
 
-	return &controller
+	hc.OnTermination(t.Stop)
+	t.Start()
 }
 
 func main() {
@@ -131,12 +246,11 @@ func main() {
 	configPath := flag.String("c", "homekit.config", "HomeKit configuration file")
 	flag.Parse()
 
-	var config HomeKitConfig
+	var config Config
 	if _, err := toml.DecodeFile(*configPath, &config); err != nil {
 		log.Fatalf("Error loading configuration: %v", err)
 	}
 
-	controller := NewHomeKitController(config, log)
-	controller.Start()
-
+	bridge := NewHomeKitBridge(config, log)
+	bridge.Start()
 }